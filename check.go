@@ -0,0 +1,127 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Check parses every migration in dir (SQL files and migrations registered
+// in code via Register) and verifies the set is safe to deploy before
+// anything runs for real: revisions must be contiguous with no gaps or
+// duplicates, and every !Up must have a matching !Down unless it's marked
+// irreversible. Once those static checks pass, Check dry-runs each pending
+// migration's SQL inside "begin; ...; rollback" against conn, so a syntax
+// error surfaces here instead of during a real Migrate. Check never commits
+// anything to schema_migrations.
+func Check(conn *sql.DB, dir string) error {
+	migrations, err := loadAll(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := checkRevisions(migrations); err != nil {
+		return err
+	}
+
+	if err := checkReversible(migrations); err != nil {
+		return err
+	}
+
+	if err := createSchemaMigrationsTable(conn); err != nil {
+		return err
+	}
+
+	done, err := applied(conn)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if done[m.Name] {
+			continue
+		}
+
+		if err := dryRun(conn, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkRevisions confirms migrations - already sorted ascending by loadAll
+// - form a contiguous, duplicate-free sequence of revision numbers.
+func checkRevisions(migrations []migration) error {
+	seen := make(map[int]string, len(migrations))
+
+	for i, m := range migrations {
+		if dup, ok := seen[m.Revision]; ok {
+			return fmt.Errorf("migrations: revision %d is used by both %s and %s", m.Revision, dup, m.Name)
+		}
+		seen[m.Revision] = m.Name
+
+		if i > 0 && m.Revision != migrations[i-1].Revision+1 {
+			return fmt.Errorf("migrations: gap in revisions between %s and %s", migrations[i-1].Name, m.Name)
+		}
+	}
+
+	return nil
+}
+
+// checkReversible confirms every SQL-file migration with an !Up also has a
+// !Down, unless it's marked irreversible. Code migrations always supply
+// both Up and Down to Register, and expand/contract migrations are
+// reverted through abortExpansion rather than a plain !Down, so neither is
+// checked here.
+func checkReversible(migrations []migration) error {
+	for _, m := range migrations {
+		if m.IsCode || m.ExpandContract || m.Irreversible {
+			continue
+		}
+
+		if m.Up != "" && m.Down == "" {
+			return fmt.Errorf("migrations: %s has !Up but no !Down; mark it \"--- !Up irreversible\" if that's intentional", m.Name)
+		}
+	}
+
+	return nil
+}
+
+// dryRun executes a single pending migration's apply SQL inside its own
+// transaction and always rolls back, to catch syntax errors without
+// applying anything. A "notx" migration is skipped: it's meant to run
+// statements PostgreSQL refuses inside a transaction block (e.g. CREATE
+// INDEX CONCURRENTLY), so there's no safe way to dry-run it.
+func dryRun(conn *sql.DB, m migration) error {
+	if m.NoTransaction {
+		return nil
+	}
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if m.IsCode {
+		if err := m.CodeUp(&operation{exec: tx}); err != nil {
+			return fmt.Errorf("migrations: dry run of %s failed: %w", m.Name, err)
+		}
+		return nil
+	}
+
+	stmt := m.Up
+	if m.ExpandContract {
+		stmt = m.ExpandUp
+	}
+
+	if stmt == "" {
+		return nil
+	}
+
+	if _, err := tx.Exec(stmt); err != nil {
+		return fmt.Errorf("migrations: dry run of %s failed: %w", m.Name, err)
+	}
+
+	return nil
+}
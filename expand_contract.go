@@ -0,0 +1,318 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Phase describes where an expand/contract migration sits in its
+// zero-downtime lifecycle.
+type Phase string
+
+const (
+	// PhasePending means the migration has been recorded but neither its
+	// expand nor its contract SQL has run yet.
+	PhasePending Phase = "pending"
+
+	// PhaseExpanded means the expand phase has run: the new shape exists
+	// alongside the old one, and both are reachable through the
+	// migration's versioned schema while the application rolls over.
+	PhaseExpanded Phase = "expanded"
+
+	// PhaseCompleted means the contract phase has run and the old shape
+	// has been removed. This is the terminal state for every migration
+	// applied through the classic Migrate/Rollback path as well.
+	PhaseCompleted Phase = "completed"
+)
+
+// addExpandContractColumns extends schema_migrations with the bookkeeping
+// an expand/contract migration needs: which lifecycle phase it's in, which
+// migration it followed, when each phase ran, and which migrations
+// directory its !Contract SQL lives in, so a later Complete call - possibly
+// in a different process entirely - can find it without depending on
+// in-process state. Plain !Up/!Down migrations are recorded straight into
+// PhaseCompleted and never touch these columns again.
+func addExpandContractColumns(conn *sql.DB) error {
+	statements := []string{
+		`alter table ` + schemaMigrationsTable + ` add column if not exists phase text not null default 'completed'`,
+		`alter table ` + schemaMigrationsTable + ` add column if not exists parent text references ` + schemaMigrationsTable + `(migration)`,
+		`alter table ` + schemaMigrationsTable + ` add column if not exists expanded_at timestamp`,
+		`alter table ` + schemaMigrationsTable + ` add column if not exists completed_at timestamp`,
+		`alter table ` + schemaMigrationsTable + ` add column if not exists source text`,
+
+		// Only one migration may be mid-flight (expanded but not yet
+		// completed) at a time.
+		`create unique index if not exists schema_migrations_one_active
+			on ` + schemaMigrationsTable + ` ((1)) where phase <> 'completed'`,
+
+		// History is linear: besides the very first migration, every
+		// row points at a distinct parent.
+		`create unique index if not exists schema_migrations_parent_unique
+			on ` + schemaMigrationsTable + ` (parent) where parent is not null`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := conn.Exec(stmt); err != nil {
+			return fmt.Errorf("migrations: failed to prepare expand/contract tracking: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// versionedSchema returns the name of the PostgreSQL schema used to expose
+// the pre- and post-migration shape of an in-flight migration, e.g.
+// "migrations_v3" for revision 3.
+func versionedSchema(revision int) string {
+	return fmt.Sprintf("migrations_v%d", revision)
+}
+
+// latestMigration returns the most recently recorded migration and its
+// phase, or ("", "", nil) if none has run yet. It's used to derive the
+// parent link for the next expand/contract migration's Start, which is
+// simply whatever ran last - regardless of phase - since Migrate/Start only
+// ever append to the history in order.
+func latestMigration(conn *sql.DB) (name string, phase Phase, err error) {
+	row := conn.QueryRow(`
+select migration, phase from ` + schemaMigrationsTable + `
+order by created_at desc limit 1`)
+
+	err = row.Scan(&name, &phase)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+
+	return name, phase, err
+}
+
+// inFlightMigration returns the expand/contract migration currently mid-
+// flight - recorded as anything other than PhaseCompleted - along with its
+// phase and the migrations directory its Start call was given, or
+// ("", "", "", nil) if nothing is in flight. schema_migrations_one_active
+// guarantees at most one row can ever match.
+func inFlightMigration(conn *sql.DB) (name string, phase Phase, source string, err error) {
+	row := conn.QueryRow(`
+select migration, phase, coalesce(source, '') from ` + schemaMigrationsTable + `
+where phase <> 'completed'
+limit 1`)
+
+	err = row.Scan(&name, &phase, &source)
+	if err == sql.ErrNoRows {
+		return "", "", "", nil
+	}
+
+	return name, phase, source, err
+}
+
+// Start begins the expand phase of an expand/contract migration: it creates
+// the migration's versioned schema, runs the migration's !Expand SQL, and
+// records the migration as PhaseExpanded so old and new application
+// binaries can run side by side against that schema while the rollout
+// completes.
+func Start(conn *sql.DB, dir string, revision int) error {
+	if err := createSchemaMigrationsTable(conn); err != nil {
+		return err
+	}
+	if err := addExpandContractColumns(conn); err != nil {
+		return err
+	}
+
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		return err
+	}
+
+	var target *migration
+	for i := range migrations {
+		if migrations[i].Revision == revision {
+			target = &migrations[i]
+			break
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("migrations: no migration found for revision %d", revision)
+	}
+	if !target.ExpandContract {
+		return fmt.Errorf("migrations: %s has no !Expand/!Contract sections", target.Name)
+	}
+
+	if inFlight, phase, _, err := inFlightMigration(conn); err != nil {
+		return err
+	} else if inFlight != "" {
+		return fmt.Errorf("migrations: %s is still %s; complete or roll it back first", inFlight, phase)
+	}
+
+	parent, _, err := latestMigration(conn)
+	if err != nil {
+		return err
+	}
+
+	schema := versionedSchema(target.Revision)
+
+	Log.Printf("Starting expand phase for %s (schema %s)", target.Name, schema)
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`create schema if not exists ` + schema); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("migrations: failed to create schema %s: %w", schema, err)
+	}
+
+	if _, err := tx.Exec(target.ExpandUp); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("migrations: failed to expand %s: %w", target.Name, err)
+	}
+
+	var parentArg interface{}
+	if parent != "" {
+		parentArg = parent
+	}
+
+	if _, err := tx.Exec(`
+insert into `+schemaMigrationsTable+` (migration, phase, parent, expanded_at, source)
+values ($1, $2, $3, now(), $4)`, target.Name, PhaseExpanded, parentArg, dir); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("migrations: failed to record expand phase for %s: %w", target.Name, err)
+	}
+
+	return tx.Commit()
+}
+
+// Complete finishes the contract phase of whichever migration is currently
+// PhaseExpanded: it drops the versioned schema now that every application
+// binary has rolled over to the new shape, then runs the migration's
+// !Contract SQL, and marks the migration PhaseCompleted. The schema goes
+// first because its views still select the old columns the contract SQL
+// removes.
+//
+// The contract SQL itself lives on disk, in the directory Start was given,
+// so Complete re-reads that directory from the source column Start
+// recorded in schema_migrations - there's no requirement that Complete run
+// in the same process, or even on the same host, as Start, so long as it
+// can see that same path (e.g. the same deployed image).
+func Complete(conn *sql.DB) error {
+	name, phase, dir, err := inFlightMigration(conn)
+	if err != nil {
+		return err
+	}
+	if phase != PhaseExpanded {
+		return fmt.Errorf("migrations: no migration is awaiting its contract phase")
+	}
+	if dir == "" {
+		return fmt.Errorf("migrations: no migrations directory recorded for %s; Start must have run before this version of the library tracked it", name)
+	}
+
+	var revision int
+	if _, err := fmt.Sscanf(name, "%d-", &revision); err != nil {
+		return fmt.Errorf("migrations: couldn't determine revision for %s: %w", name, err)
+	}
+
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		return err
+	}
+
+	var target *migration
+	for i := range migrations {
+		if migrations[i].Name == name {
+			target = &migrations[i]
+			break
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("migrations: couldn't find %s in %s", name, dir)
+	}
+
+	schema := versionedSchema(revision)
+
+	Log.Printf("Completing contract phase for %s (schema %s)", target.Name, schema)
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`drop schema if exists ` + schema + ` cascade`); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("migrations: failed to drop schema %s: %w", schema, err)
+	}
+
+	if _, err := tx.Exec(target.ContractUp); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("migrations: failed to contract %s: %w", target.Name, err)
+	}
+
+	if _, err := tx.Exec(`
+update `+schemaMigrationsTable+` set phase = $1, completed_at = now() where migration = $2`,
+		PhaseCompleted, target.Name); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("migrations: failed to record contract phase for %s: %w", target.Name, err)
+	}
+
+	return tx.Commit()
+}
+
+// abortExpansion undoes an in-flight expand/contract migration above
+// revision by running its !ExpandDown SQL, dropping its versioned schema,
+// and removing its schema_migrations row. It's a no-op if no migration is
+// currently PhaseExpanded, or if the expanded migration is at or below
+// revision.
+func abortExpansion(conn *sql.DB, dir string, revision int) error {
+	name, phase, _, err := inFlightMigration(conn)
+	if err != nil || phase != PhaseExpanded {
+		return err
+	}
+
+	var ecRevision int
+	if _, err := fmt.Sscanf(name, "%d-", &ecRevision); err != nil {
+		return fmt.Errorf("migrations: couldn't determine revision for %s: %w", name, err)
+	}
+	if ecRevision <= revision {
+		return nil
+	}
+
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		return err
+	}
+
+	var target *migration
+	for i := range migrations {
+		if migrations[i].Name == name {
+			target = &migrations[i]
+			break
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("migrations: couldn't find %s in %s", name, dir)
+	}
+
+	schema := versionedSchema(ecRevision)
+
+	Log.Printf("Aborting expand phase for %s (schema %s)", target.Name, schema)
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(target.ExpandDown); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("migrations: failed to undo expand phase for %s: %w", target.Name, err)
+	}
+
+	if _, err := tx.Exec(`drop schema if exists ` + schema + ` cascade`); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("migrations: failed to drop schema %s: %w", schema, err)
+	}
+
+	if _, err := tx.Exec(`delete from `+schemaMigrationsTable+` where migration = $1`, target.Name); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("migrations: failed to unrecord %s: %w", target.Name, err)
+	}
+
+	return tx.Commit()
+}
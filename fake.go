@@ -0,0 +1,105 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// MigrateFake brings schema_migrations to revision the same way Migrate
+// does, but never executes any migration's SQL - it only records (or
+// removes) tracking rows. It's meant for bootstrapping this library against
+// a database whose schema already matches revision, which is the usual
+// situation when adopting migrations mid-project.
+//
+// Like apply and revert, MigrateFake refuses to touch an expand/contract
+// migration: faking one would insert a bare schema_migrations row with none
+// of the phase/parent bookkeeping Start and Complete rely on, silently
+// skipping that migration's lifecycle. Use Start and Complete instead.
+func MigrateFake(conn *sql.DB, dir string, revision int) error {
+	return withLock(conn, dir, func(conn *sql.DB) error {
+		if err := createSchemaMigrationsTable(conn); err != nil {
+			return err
+		}
+
+		migrations, err := loadAll(dir)
+		if err != nil {
+			return err
+		}
+
+		done, err := applied(conn)
+		if err != nil {
+			return err
+		}
+
+		sortMigrationsAscending(migrations)
+
+		for _, m := range migrations {
+			if m.Revision > revision || done[m.Name] {
+				continue
+			}
+
+			if m.ExpandContract {
+				return fmt.Errorf("migrations: %s is an expand/contract migration and can't be faked; use Start and Complete instead", m.Name)
+			}
+
+			Log.Printf("Faking migration %s", m.Name)
+
+			if _, err := conn.Exec(`insert into `+schemaMigrationsTable+` (migration) values ($1)`, m.Name); err != nil {
+				return fmt.Errorf("migrations: failed to fake %s: %w", m.Name, err)
+			}
+		}
+
+		sort.Slice(migrations, func(i, j int) bool {
+			return migrations[i].Revision > migrations[j].Revision
+		})
+
+		for _, m := range migrations {
+			if m.Revision <= revision || !done[m.Name] {
+				continue
+			}
+
+			if m.ExpandContract {
+				return fmt.Errorf("migrations: %s is an expand/contract migration and can't be unfaked; use Start and Complete instead", m.Name)
+			}
+
+			Log.Printf("Unfaking migration %s", m.Name)
+
+			if _, err := conn.Exec(`delete from `+schemaMigrationsTable+` where migration = $1`, m.Name); err != nil {
+				return fmt.Errorf("migrations: failed to unfake %s: %w", m.Name, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// FakeOne records a single migration in schema_migrations without running
+// its SQL, for skipping one migration in an otherwise real Migrate run -
+// e.g. the manual `insert into schema_migrations` TestTransactions uses to
+// skip 3-no-tx.sql.
+func FakeOne(conn *sql.DB, dir, name string) error {
+	if err := createSchemaMigrationsTable(conn); err != nil {
+		return err
+	}
+
+	migrations, err := loadAll(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Name == name {
+			if m.ExpandContract {
+				return fmt.Errorf("migrations: %s is an expand/contract migration and can't be faked; use Start and Complete instead", m.Name)
+			}
+
+			Log.Printf("Faking migration %s", m.Name)
+
+			_, err := conn.Exec(`insert into `+schemaMigrationsTable+` (migration) values ($1)`, m.Name)
+			return err
+		}
+	}
+
+	return fmt.Errorf("migrations: no migration named %s in %s", name, dir)
+}
@@ -0,0 +1,135 @@
+package migrations
+
+import (
+	"database/sql"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// loadMigrationsFS reads and parses every *.sql file at the root of fsys,
+// returning them sorted in ascending revision order. It's the fs.FS
+// equivalent of loadMigrations, letting migrations ship embedded in a
+// binary via //go:embed instead of living on disk.
+func loadMigrationsFS(fsys fs.FS) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+
+		contents, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, err := parseMigration(entry.Name(), string(contents))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, m)
+	}
+
+	sortMigrationsAscending(migrations)
+
+	return migrations, nil
+}
+
+// loadAllFS combines the SQL files at the root of fsys with any migrations
+// registered in code via Register, sorted together in ascending revision
+// order.
+func loadAllFS(fsys fs.FS) ([]migration, error) {
+	migrations, err := loadMigrationsFS(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations = append(migrations, codeMigrations()...)
+	sortMigrationsAscending(migrations)
+
+	return migrations, nil
+}
+
+// fsLockName derives a withLock key that identifies fsys's particular set of
+// migration files, from their sorted names, so that two distinct embedded
+// migration sets - or two unrelated services sharing a Postgres instance -
+// don't serialize against each other under one shared key the way a literal
+// constant would.
+func fsLockName(fsys fs.FS) (string, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return "", err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+
+		names = append(names, entry.Name())
+	}
+
+	// fs.ReadDir already returns entries sorted by file name.
+	return "fs-migrations:" + strings.Join(names, ","), nil
+}
+
+// MigrateFS behaves exactly like Migrate, but reads migrations from the
+// root of fsys instead of a directory path, so they can be embedded in the
+// binary with //go:embed:
+//
+//	//go:embed sql/*.sql
+//	var sqlMigrations embed.FS
+//
+//	sub, _ := fs.Sub(sqlMigrations, "sql")
+//	migrations.MigrateFS(conn, sub, revision)
+//
+// Like Migrate, the advisory lock MigrateFS holds is scoped to the
+// migration set - here, fsys's list of file names - so distinct fsys values
+// get independent locks instead of serializing against each other.
+func MigrateFS(conn *sql.DB, fsys fs.FS, revision int) error {
+	name, err := fsLockName(fsys)
+	if err != nil {
+		return err
+	}
+
+	return withLock(conn, name, func(conn *sql.DB) error {
+		return doMigrateFS(conn, fsys, revision)
+	})
+}
+
+// doMigrateFS is MigrateFS's implementation, run while the migration lock
+// is held.
+func doMigrateFS(conn *sql.DB, fsys fs.FS, revision int) error {
+	migrations, err := loadAllFS(fsys)
+	if err != nil {
+		return err
+	}
+
+	return runMigrations(conn, migrations, revision, nil)
+}
+
+// RollbackFS behaves exactly like Rollback, but reads migrations from the
+// root of fsys instead of a directory path. Expand/contract migrations
+// aren't supported from an fs.FS yet, since Start and Complete still need a
+// directory path to re-read the in-flight migration's contract SQL; embed
+// those migrations' directory on disk if you need both.
+//
+// Like MigrateFS, the advisory lock RollbackFS holds is scoped to fsys's
+// list of file names, not a single constant shared by every caller.
+func RollbackFS(conn *sql.DB, fsys fs.FS, revision int) error {
+	name, err := fsLockName(fsys)
+	if err != nil {
+		return err
+	}
+
+	return withLock(conn, name, func(conn *sql.DB) error {
+		return doMigrateFS(conn, fsys, revision)
+	})
+}
@@ -0,0 +1,111 @@
+package migrations
+
+import "database/sql"
+
+// Direction indicates whether a migration is being applied or rolled back,
+// passed to a Runner's Before/AfterEach and OnFailure hooks.
+type Direction string
+
+const (
+	// Up is passed to a hook when its migration's !Up (or registered Up
+	// function) is running.
+	Up Direction = "up"
+
+	// Down is passed to a hook when its migration's !Down (or registered
+	// Down function) is running.
+	Down Direction = "down"
+)
+
+// Runner drives Migrate and Rollback the same way the package-level
+// functions do, but lets callers hook into the run to emit metrics, send
+// notifications, or run integrity checks alongside each migration.
+//
+// BeforeMigrate and AfterMigrate run once per Migrate/Rollback call, before
+// the first migration and after the last. BeforeEach and AfterEach run
+// around every individual migration, and are passed tx, the *sql.Tx the
+// migration ran in (or the *sql.DB directly, for a "notx" migration), so a
+// hook can run its own statements in the same transaction. Returning an
+// error from BeforeEach or AfterEach aborts the migration: BeforeEach skips
+// it entirely, and AfterEach rolls back a transactional migration that
+// already ran. OnFailure is called, instead, when the migration itself (or
+// recording it in schema_migrations) fails.
+//
+// A nil Runner behaves like the package-level Migrate/Rollback functions -
+// every hook is optional and may be left nil.
+type Runner struct {
+	BeforeMigrate func() error
+	AfterMigrate  func() error
+	BeforeEach    func(name string, direction Direction, tx interface{}) error
+	AfterEach     func(name string, direction Direction, tx interface{}) error
+	OnFailure     func(name string, direction Direction, err error)
+}
+
+// Migrate behaves exactly like the package-level Migrate, but fires r's
+// hooks around the run and each migration it applies or rolls back.
+func (r *Runner) Migrate(conn *sql.DB, dir string, revision int) error {
+	return withLock(conn, dir, func(conn *sql.DB) error {
+		return r.run(conn, dir, revision, doMigrate)
+	})
+}
+
+// Rollback behaves exactly like the package-level Rollback, but fires r's
+// hooks around the run and each migration it rolls back.
+func (r *Runner) Rollback(conn *sql.DB, dir string, revision int) error {
+	return withLock(conn, dir, func(conn *sql.DB) error {
+		if err := createSchemaMigrationsTable(conn); err != nil {
+			return err
+		}
+		if err := addExpandContractColumns(conn); err != nil {
+			return err
+		}
+		if err := abortExpansion(conn, dir, revision); err != nil {
+			return err
+		}
+
+		return r.run(conn, dir, revision, doMigrate)
+	})
+}
+
+// run wraps fn - doMigrate, under the migration lock - with r's
+// BeforeMigrate/AfterMigrate hooks.
+func (r *Runner) run(conn *sql.DB, dir string, revision int, fn func(*sql.DB, string, int, *Runner) error) error {
+	if r != nil && r.BeforeMigrate != nil {
+		if err := r.BeforeMigrate(); err != nil {
+			return err
+		}
+	}
+
+	if err := fn(conn, dir, revision, r); err != nil {
+		return err
+	}
+
+	if r != nil && r.AfterMigrate != nil {
+		return r.AfterMigrate()
+	}
+
+	return nil
+}
+
+// beforeEach calls r's BeforeEach hook, if both r and the hook are set.
+func (r *Runner) beforeEach(name string, direction Direction, tx interface{}) error {
+	if r == nil || r.BeforeEach == nil {
+		return nil
+	}
+	return r.BeforeEach(name, direction, tx)
+}
+
+// afterEach calls r's AfterEach hook, if both r and the hook are set.
+func (r *Runner) afterEach(name string, direction Direction, tx interface{}) error {
+	if r == nil || r.AfterEach == nil {
+		return nil
+	}
+	return r.AfterEach(name, direction, tx)
+}
+
+// onFailure calls r's OnFailure hook, if both r and the hook are set.
+func (r *Runner) onFailure(name string, direction Direction, err error) {
+	if r == nil || r.OnFailure == nil {
+		return
+	}
+	r.OnFailure(name, direction, err)
+}
@@ -0,0 +1,87 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"hash/fnv"
+	"time"
+)
+
+// ErrLocked is returned by Migrate and Rollback when another process holds
+// the migration lock for longer than LockTimeout.
+var ErrLocked = errors.New("migrations: could not acquire migration lock")
+
+// LockTimeout bounds how long Migrate and Rollback will wait to acquire the
+// migration lock before giving up and returning ErrLocked.
+var LockTimeout = 10 * time.Second
+
+// LockKey, if set, is used as the PostgreSQL advisory lock key instead of a
+// hash of the migrations directory. Set this when several directories
+// should share a lock, or when different processes refer to the same
+// migrations by different paths.
+var LockKey int64
+
+// lockPollInterval is how often a blocked Migrate/Rollback retries
+// pg_try_advisory_lock while waiting out LockTimeout.
+const lockPollInterval = 100 * time.Millisecond
+
+// lockKey derives the advisory lock key for dir, honoring LockKey if it's
+// been set.
+func lockKey(dir string) int64 {
+	if LockKey != 0 {
+		return LockKey
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(dir))
+	return int64(h.Sum64())
+}
+
+// withLock acquires a session-level PostgreSQL advisory lock scoped to dir,
+// runs fn, then releases the lock. The lock is held on a single dedicated
+// connection, checked out of conn's pool via conn.Conn, for the duration of
+// fn, since pg_advisory_unlock only works from the session that took the
+// lock - but fn itself runs the migration work against conn directly, which
+// therefore needs to check out further connections from the very same pool
+// while the lock-holder connection sits outside it. conn must allow at
+// least 2 simultaneous connections (i.e. not be configured with
+// db.SetMaxOpenConns(1)): with a pool capped at 1, fn will block forever
+// waiting for a connection that withLock is holding, and LockTimeout won't
+// help, since it only bounds the advisory-lock polling loop below, not this
+// wait.
+func withLock(conn *sql.DB, dir string, fn func(*sql.DB) error) error {
+	ctx := context.Background()
+
+	dbConn, err := conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Close()
+
+	key := lockKey(dir)
+	deadline := time.Now().Add(LockTimeout)
+
+	for {
+		var locked bool
+		if err := dbConn.QueryRowContext(ctx, `select pg_try_advisory_lock($1)`, key).Scan(&locked); err != nil {
+			return err
+		}
+
+		if locked {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return ErrLocked
+		}
+
+		time.Sleep(lockPollInterval)
+	}
+
+	defer func() {
+		_, _ = dbConn.ExecContext(ctx, `select pg_advisory_unlock($1)`, key)
+	}()
+
+	return fn(conn)
+}
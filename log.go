@@ -0,0 +1,40 @@
+package migrations
+
+import "log"
+
+// Logger defines the logging functions the migrations package needs in
+// order to report progress and errors.  Implement this interface to hook
+// migrations up to whatever logging framework your application uses.
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Println(v ...interface{})
+}
+
+// StdoutLogger logs migration activity through the standard log package's
+// logger, which writes to stderr unless redirected with log.SetOutput.
+// This is the default logger.
+type StdoutLogger struct{}
+
+// Printf logs a formatted message through the standard log package.
+func (l *StdoutLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// Println logs a message through the standard log package.
+func (l *StdoutLogger) Println(v ...interface{}) {
+	log.Println(v...)
+}
+
+// NilLogger discards all log output.  Useful in tests where migration
+// progress shouldn't clutter the test output.
+type NilLogger struct{}
+
+// Printf does nothing.
+func (l *NilLogger) Printf(format string, v ...interface{}) {}
+
+// Println does nothing.
+func (l *NilLogger) Println(v ...interface{}) {}
+
+// Log is the package-level logger used to report migration progress.
+// Replace it to control verbosity, e.g. `migrations.Log = new(migrations.NilLogger)`.
+var Log Logger = new(StdoutLogger)
@@ -0,0 +1,482 @@
+// Package migrations provides a small, dependency-light PostgreSQL schema
+// migration runner.  Migrations are plain SQL files living in a directory,
+// each split into an "!Up" and a "!Down" section (or, for zero-downtime
+// migrations driven by Start and Complete, "!Expand" and "!Contract"
+// sections), or Go functions added with Register.  They are tracked in a
+// schema_migrations table so that Migrate and Rollback only ever apply the
+// migrations needed to reach the requested revision.
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// directive matches a section header line, e.g. "--- !Up", "--- !Down notx"
+// or "--- !Expand".
+var directive = regexp.MustCompile(`^---\s*!(Up|Down|Expand|ExpandDown|Contract|ContractDown)\b(.*)$`)
+
+// revisionPrefix extracts the leading revision number from a migration
+// file's name, e.g. "4-add-bad-column.sql" -> 4.
+var revisionPrefix = regexp.MustCompile(`^(\d+)-`)
+
+// migration represents a single parsed migration file. A file is either a
+// classic migration, using Up/Down, or a zero-downtime one, using
+// Expand/ExpandDown/Contract/ContractDown - the two styles aren't mixed
+// within a single file.
+type migration struct {
+	Name          string
+	Revision      int
+	Up            string
+	Down          string
+	NoTransaction bool
+	Irreversible  bool
+
+	ExpandContract bool
+	ExpandUp       string
+	ExpandDown     string
+	ContractUp     string
+	ContractDown   string
+
+	// IsCode, CodeUp and CodeDown hold a migration registered via
+	// Register instead of loaded from a SQL file.
+	IsCode   bool
+	CodeUp   func(Operation) error
+	CodeDown func(Operation) error
+}
+
+// schemaMigrationsTable is the name of the table used to track which
+// migrations have been applied.
+const schemaMigrationsTable = "schema_migrations"
+
+// createSchemaMigrationsTable creates the tracking table if it doesn't
+// already exist.
+func createSchemaMigrationsTable(conn *sql.DB) error {
+	_, err := conn.Exec(`
+create table if not exists ` + schemaMigrationsTable + ` (
+	migration text primary key,
+	created_at timestamp not null default now()
+)`)
+	return err
+}
+
+// applied returns the set of migration file names already recorded in
+// schema_migrations.
+func applied(conn *sql.DB) (map[string]bool, error) {
+	rows, err := conn.Query(`select migration from ` + schemaMigrationsTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	done := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		done[name] = true
+	}
+
+	return done, rows.Err()
+}
+
+// loadMigrations reads and parses every *.sql file in dir, returning them
+// sorted in ascending revision order. It's a thin wrapper around
+// loadMigrationsFS for callers working with a directory path rather than an
+// fs.FS.
+func loadMigrations(dir string) ([]migration, error) {
+	return loadMigrationsFS(os.DirFS(dir))
+}
+
+// sortMigrationsAscending sorts migrations in place by ascending revision.
+func sortMigrationsAscending(migrations []migration) {
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Revision < migrations[j].Revision
+	})
+}
+
+// parseMigration splits a migration file's contents into its !Up and !Down
+// sections.
+func parseMigration(name, contents string) (migration, error) {
+	m := migration{Name: name}
+
+	match := revisionPrefix.FindStringSubmatch(name)
+	if match == nil {
+		return m, fmt.Errorf("migrations: %s doesn't start with a revision number", name)
+	}
+
+	revision, err := strconv.Atoi(match[1])
+	if err != nil {
+		return m, fmt.Errorf("migrations: invalid revision number in %s: %w", name, err)
+	}
+	m.Revision = revision
+
+	var section string
+	var body strings.Builder
+
+	flush := func() {
+		switch section {
+		case "Up":
+			m.Up = strings.TrimSpace(body.String())
+		case "Down":
+			m.Down = strings.TrimSpace(body.String())
+		case "Expand":
+			m.ExpandContract = true
+			m.ExpandUp = strings.TrimSpace(body.String())
+		case "ExpandDown":
+			m.ExpandDown = strings.TrimSpace(body.String())
+		case "Contract":
+			m.ContractUp = strings.TrimSpace(body.String())
+		case "ContractDown":
+			m.ContractDown = strings.TrimSpace(body.String())
+		}
+		body.Reset()
+	}
+
+	for _, line := range strings.Split(contents, "\n") {
+		if groups := directive.FindStringSubmatch(line); groups != nil {
+			flush()
+
+			section = groups[1]
+			if strings.Contains(strings.ToLower(groups[2]), "notx") {
+				m.NoTransaction = true
+			}
+			if section == "Up" && strings.Contains(strings.ToLower(groups[2]), "irreversible") {
+				m.Irreversible = true
+			}
+
+			continue
+		}
+
+		body.WriteString(line)
+		body.WriteString("\n")
+	}
+	flush()
+
+	return m, nil
+}
+
+// codeMigrations converts every migration registered via Register into a
+// migration value, for merging alongside SQL files.
+func codeMigrations() []migration {
+	migrations := make([]migration, 0, len(registered))
+	for _, c := range registered {
+		migrations = append(migrations, migration{
+			Name:     c.name(),
+			Revision: c.Revision,
+			IsCode:   true,
+			CodeUp:   c.Up,
+			CodeDown: c.Down,
+		})
+	}
+	return migrations
+}
+
+// loadAll combines the SQL files in dir with any migrations registered in
+// code via Register, sorted together in ascending revision order.
+func loadAll(dir string) ([]migration, error) {
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations = append(migrations, codeMigrations()...)
+	sortMigrationsAscending(migrations)
+
+	return migrations, nil
+}
+
+// Migrate brings the database in dir up or down to exactly revision,
+// applying any pending migrations at or below revision in ascending order
+// and rolling back any applied migrations above revision in descending
+// order.  Each migration is recorded in (or removed from) schema_migrations
+// as it succeeds.  Migrations run inside a transaction unless marked
+// "notx", in which case they run as a single statement batch against the
+// connection directly and are only recorded if they complete successfully.
+// Both SQL-file migrations in dir and migrations registered in code via
+// Register are applied together in revision order.
+//
+// Migrate holds a PostgreSQL advisory lock scoped to dir for the duration
+// of the run, so that concurrent processes - e.g. several app instances
+// booting at once - don't race on schema_migrations. If the lock can't be
+// acquired within LockTimeout, Migrate returns ErrLocked. conn must allow at
+// least 2 simultaneous connections: the lock itself pins one connection for
+// the duration of the run, and the migration work needs another from the
+// same pool (see withLock).
+func Migrate(conn *sql.DB, dir string, revision int) error {
+	return withLock(conn, dir, func(conn *sql.DB) error {
+		return doMigrate(conn, dir, revision, nil)
+	})
+}
+
+// doMigrate is Migrate's implementation, run while the migration lock is
+// held. r is the Runner driving the call, or nil if it was reached through
+// the package-level Migrate/Rollback functions, which don't support hooks.
+func doMigrate(conn *sql.DB, dir string, revision int, r *Runner) error {
+	migrations, err := loadAll(dir)
+	if err != nil {
+		return err
+	}
+
+	return runMigrations(conn, migrations, revision, r)
+}
+
+// runMigrations brings conn to revision given an already-loaded set of
+// migrations, applying pending ones in ascending order and rolling back
+// applied ones above revision in descending order.
+func runMigrations(conn *sql.DB, migrations []migration, revision int, r *Runner) error {
+	if err := createSchemaMigrationsTable(conn); err != nil {
+		return err
+	}
+
+	done, err := applied(conn)
+	if err != nil {
+		return err
+	}
+
+	sortMigrationsAscending(migrations)
+
+	for _, m := range migrations {
+		if m.Revision > revision || done[m.Name] {
+			continue
+		}
+
+		if err := apply(conn, m, r); err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Revision > migrations[j].Revision
+	})
+
+	for _, m := range migrations {
+		if m.Revision <= revision || !done[m.Name] {
+			continue
+		}
+
+		if err := revert(conn, m, r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rollback reverts the database in dir down to, but not including,
+// revision.  It's a convenience wrapper around Migrate for callers who only
+// ever move backwards and want that intent to read clearly at the call
+// site. If an expand/contract migration above revision is mid-flight
+// (PhaseExpanded), Rollback aborts it first by running its !ExpandDown SQL
+// and dropping its versioned schema, before falling through to the usual
+// classic migrations.
+//
+// Rollback holds the same advisory lock as Migrate, and returns ErrLocked
+// under the same conditions.
+func Rollback(conn *sql.DB, dir string, revision int) error {
+	return withLock(conn, dir, func(conn *sql.DB) error {
+		if err := createSchemaMigrationsTable(conn); err != nil {
+			return err
+		}
+		if err := addExpandContractColumns(conn); err != nil {
+			return err
+		}
+
+		if err := abortExpansion(conn, dir, revision); err != nil {
+			return err
+		}
+
+		return doMigrate(conn, dir, revision, nil)
+	})
+}
+
+// apply runs a single migration's !Up section and records it. r's BeforeEach,
+// AfterEach and OnFailure hooks, if set, run around the migration's own
+// transaction (or conn directly, for a "notx" migration).
+func apply(conn *sql.DB, m migration, r *Runner) error {
+	if m.ExpandContract {
+		return fmt.Errorf("migrations: %s is an expand/contract migration; use Start and Complete instead of Migrate", m.Name)
+	}
+
+	Log.Printf("Applying migration %s", m.Name)
+
+	if m.IsCode {
+		tx, err := conn.Begin()
+		if err != nil {
+			return err
+		}
+
+		if err := r.beforeEach(m.Name, Up, tx); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if err := m.CodeUp(&operation{exec: tx}); err != nil {
+			_ = tx.Rollback()
+			r.onFailure(m.Name, Up, err)
+			return fmt.Errorf("migrations: failed to apply %s: %w", m.Name, err)
+		}
+
+		if _, err := tx.Exec(`insert into `+schemaMigrationsTable+` (migration) values ($1)`, m.Name); err != nil {
+			_ = tx.Rollback()
+			r.onFailure(m.Name, Up, err)
+			return fmt.Errorf("migrations: failed to record %s: %w", m.Name, err)
+		}
+
+		if err := r.afterEach(m.Name, Up, tx); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		return tx.Commit()
+	}
+
+	if m.NoTransaction {
+		if err := r.beforeEach(m.Name, Up, conn); err != nil {
+			return err
+		}
+
+		if _, err := conn.Exec(m.Up); err != nil {
+			r.onFailure(m.Name, Up, err)
+			return fmt.Errorf("migrations: failed to apply %s: %w", m.Name, err)
+		}
+
+		if _, err := conn.Exec(`insert into `+schemaMigrationsTable+` (migration) values ($1)`, m.Name); err != nil {
+			r.onFailure(m.Name, Up, err)
+			return fmt.Errorf("migrations: failed to record %s: %w", m.Name, err)
+		}
+
+		return r.afterEach(m.Name, Up, conn)
+	}
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := r.beforeEach(m.Name, Up, tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(m.Up); err != nil {
+		_ = tx.Rollback()
+		r.onFailure(m.Name, Up, err)
+		return fmt.Errorf("migrations: failed to apply %s: %w", m.Name, err)
+	}
+
+	if _, err := tx.Exec(`insert into `+schemaMigrationsTable+` (migration) values ($1)`, m.Name); err != nil {
+		_ = tx.Rollback()
+		r.onFailure(m.Name, Up, err)
+		return fmt.Errorf("migrations: failed to record %s: %w", m.Name, err)
+	}
+
+	if err := r.afterEach(m.Name, Up, tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("migrations: failed to commit %s: %w", m.Name, err)
+	}
+
+	return nil
+}
+
+// revert runs a single migration's !Down section and unrecords it. r's
+// hooks run the same way they do in apply, with direction Down.
+func revert(conn *sql.DB, m migration, r *Runner) error {
+	if m.ExpandContract {
+		return fmt.Errorf("migrations: %s is a completed expand/contract migration and can't be rolled back", m.Name)
+	}
+
+	Log.Printf("Rolling back migration %s", m.Name)
+
+	if m.IsCode {
+		tx, err := conn.Begin()
+		if err != nil {
+			return err
+		}
+
+		if err := r.beforeEach(m.Name, Down, tx); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if err := m.CodeDown(&operation{exec: tx}); err != nil {
+			_ = tx.Rollback()
+			r.onFailure(m.Name, Down, err)
+			return fmt.Errorf("migrations: failed to roll back %s: %w", m.Name, err)
+		}
+
+		if _, err := tx.Exec(`delete from `+schemaMigrationsTable+` where migration = $1`, m.Name); err != nil {
+			_ = tx.Rollback()
+			r.onFailure(m.Name, Down, err)
+			return fmt.Errorf("migrations: failed to unrecord %s: %w", m.Name, err)
+		}
+
+		if err := r.afterEach(m.Name, Down, tx); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		return tx.Commit()
+	}
+
+	if m.NoTransaction {
+		if err := r.beforeEach(m.Name, Down, conn); err != nil {
+			return err
+		}
+
+		if _, err := conn.Exec(m.Down); err != nil {
+			r.onFailure(m.Name, Down, err)
+			return fmt.Errorf("migrations: failed to roll back %s: %w", m.Name, err)
+		}
+
+		if _, err := conn.Exec(`delete from `+schemaMigrationsTable+` where migration = $1`, m.Name); err != nil {
+			r.onFailure(m.Name, Down, err)
+			return fmt.Errorf("migrations: failed to unrecord %s: %w", m.Name, err)
+		}
+
+		return r.afterEach(m.Name, Down, conn)
+	}
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := r.beforeEach(m.Name, Down, tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(m.Down); err != nil {
+		_ = tx.Rollback()
+		r.onFailure(m.Name, Down, err)
+		return fmt.Errorf("migrations: failed to roll back %s: %w", m.Name, err)
+	}
+
+	if _, err := tx.Exec(`delete from `+schemaMigrationsTable+` where migration = $1`, m.Name); err != nil {
+		_ = tx.Rollback()
+		r.onFailure(m.Name, Down, err)
+		return fmt.Errorf("migrations: failed to unrecord %s: %w", m.Name, err)
+	}
+
+	if err := r.afterEach(m.Name, Down, tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("migrations: failed to commit rollback of %s: %w", m.Name, err)
+	}
+
+	return nil
+}
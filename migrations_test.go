@@ -2,13 +2,21 @@ package migrations_test
 
 import (
 	"database/sql"
+	"embed"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/sbowman/migrations"
 )
 
+//go:embed sql
+var embeddedSQL embed.FS
+
 const (
 	// TableExists queries for the table in the PostgreSQL metadata.
 	TableExists = `
@@ -20,6 +28,14 @@ select exists
 
 var conn *sql.DB
 
+func init() {
+	migrations.Register(6, func(op migrations.Operation) error {
+		return op.CreateTable("widgets", "id serial primary key", "label text not null")
+	}, func(op migrations.Operation) error {
+		return op.DropTable("widgets")
+	})
+}
+
 func TestMain(m *testing.M) {
 	var err error
 
@@ -273,6 +289,594 @@ func TestNoTxFlag(t *testing.T) {
 	}
 }
 
+// Confirm the expand/contract lifecycle creates a versioned schema during
+// the expand phase and cleans it up once the contract phase completes.
+func TestExpandContract(t *testing.T) {
+	defer clean(t)
+
+	if err := migrate(2); err != nil {
+		t.Fatalf("Unable to run migration to revision 2: %s", err)
+	}
+
+	if err := migrations.Start(conn, "./sql", 5); err != nil {
+		t.Fatalf("Unable to start expand phase: %s", err)
+	}
+
+	if err := tableExists("samples"); err != nil {
+		t.Fatal("Sample table should still exist during the expand phase")
+	}
+
+	if _, err := conn.Exec("insert into samples (name, first_name, last_name) values ('Bob', 'Bob', 'Jones')"); err != nil {
+		t.Errorf("Expected to be able to write to both the old and new columns: %s", err)
+	}
+
+	if _, err := conn.Query("select first_name, last_name from migrations_v5.samples_post"); err != nil {
+		t.Errorf("Expected the versioned schema's post view to exist: %s", err)
+	}
+
+	// Starting a second expand phase while one is in flight should fail.
+	if err := migrations.Start(conn, "./sql", 5); err == nil {
+		t.Error("Expected starting a second expand phase to fail while one is active")
+	}
+
+	if err := migrations.Complete(conn); err != nil {
+		t.Fatalf("Unable to complete contract phase: %s", err)
+	}
+
+	if _, err := conn.Query("select name from samples"); err == nil {
+		t.Error("Expected the name column to be dropped after the contract phase")
+	}
+
+	if err := schemaExists("migrations_v5"); err == nil {
+		t.Error("Expected the versioned schema to be dropped after the contract phase")
+	}
+}
+
+// Rolling back past an in-flight expand phase should abort it rather than
+// leaving the versioned schema and the new columns behind.
+func TestExpandRollback(t *testing.T) {
+	defer clean(t)
+
+	if err := migrate(2); err != nil {
+		t.Fatalf("Unable to run migration to revision 2: %s", err)
+	}
+
+	if err := migrations.Start(conn, "./sql", 5); err != nil {
+		t.Fatalf("Unable to start expand phase: %s", err)
+	}
+
+	if err := migrations.Rollback(conn, "./sql", 2); err != nil {
+		t.Fatalf("Unable to roll back the in-flight expand phase: %s", err)
+	}
+
+	if _, err := conn.Query("select first_name from samples"); err == nil {
+		t.Error("Expected the expand phase's new columns to be rolled back")
+	}
+}
+
+// Confirm Start records the migrations directory in schema_migrations
+// itself, not just in process memory, so Complete can find its !Contract
+// SQL from a process that never called Start.
+func TestStartRecordsSourceForComplete(t *testing.T) {
+	defer clean(t)
+
+	if err := migrate(2); err != nil {
+		t.Fatalf("Unable to run migration to revision 2: %s", err)
+	}
+
+	if err := migrations.Start(conn, "./sql", 5); err != nil {
+		t.Fatalf("Unable to start expand phase: %s", err)
+	}
+
+	// Abort the expand phase before clean runs, since the versioned schema's
+	// views depend on the samples table clean drops.
+	defer func() { _ = migrations.Rollback(conn, "./sql", 2) }()
+
+	var source string
+	if err := conn.QueryRow("select source from schema_migrations where migration = $1", "5-split-name-expand-contract.sql").Scan(&source); err != nil {
+		t.Fatalf("Unable to query the recorded source directory: %s", err)
+	}
+
+	if source != "./sql" {
+		t.Errorf("Expected the source column to record %q, got %q", "./sql", source)
+	}
+}
+
+// Confirm a migration registered in code via Register runs alongside the
+// SQL file migrations, in revision order.
+func TestOperations(t *testing.T) {
+	defer clean(t)
+
+	if err := migrate(2); err != nil {
+		t.Fatalf("Unable to run migration to revision 2: %s", err)
+	}
+
+	// Skip 3 and 4, which fail by design, and 5, which Migrate refuses as an
+	// expand/contract migration, the same way TestTransactions skips 3.
+	for _, name := range []string{"3-no-tx.sql", "4-add-bad-column.sql", "5-split-name-expand-contract.sql"} {
+		if _, err := conn.Exec("insert into schema_migrations (migration) values ($1)", name); err != nil {
+			t.Fatalf("Failed to skip %s: %s", name, err)
+		}
+	}
+
+	if err := migrate(6); err != nil {
+		t.Fatalf("Unable to run migration to revision 6: %s", err)
+	}
+
+	if err := tableExists("widgets"); err != nil {
+		t.Fatal("Expected the widgets table to be created by the registered migration")
+	}
+
+	if err := migrate(5); err != nil {
+		t.Fatalf("Unable to roll back to revision 5: %s", err)
+	}
+
+	if err := tableExists("widgets"); err == nil {
+		t.Error("Expected the widgets table to be dropped after rolling back past revision 6")
+	}
+}
+
+// Confirm two concurrent callers racing to migrate the same directory don't
+// clobber each other: the advisory lock should serialize them so exactly
+// one applies the migrations and the other either waits its turn or, if
+// LockTimeout is too short to wait, comes back with ErrLocked.
+//
+// To prove the lock is actually what's serializing them - rather than both
+// just happening to run one after another and passing by luck - one
+// goroutine is made to hold the lock well past a shortened LockTimeout, via
+// a Runner hook that sleeps on the first migration. That forces the other
+// goroutine to give up waiting and come back with ErrLocked once the
+// shortened timeout passes, while the first goroutine still holds the lock.
+// Revision 2 is the target because migrating any further always fails at
+// 3-no-tx.sql.
+func TestConcurrentMigrate(t *testing.T) {
+	defer clean(t)
+
+	original := migrations.LockTimeout
+	migrations.LockTimeout = 150 * time.Millisecond
+	defer func() { migrations.LockTimeout = original }()
+
+	var holding int32
+
+	r := &migrations.Runner{
+		BeforeEach: func(name string, direction migrations.Direction, tx interface{}) error {
+			if name == "1-create-sample.sql" && atomic.CompareAndSwapInt32(&holding, 0, 1) {
+				// Hold the lock well past LockTimeout, so the
+				// other goroutine can't be migrating at the same
+				// time without the lock having failed to do its job.
+				time.Sleep(400 * time.Millisecond)
+			}
+			return nil
+		},
+	}
+
+	errs := make(chan error, 2)
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- r.Migrate(conn, "./sql", 2)
+		}()
+	}
+
+	var succeeded, locked int
+	for i := 0; i < 2; i++ {
+		switch err := <-errs; {
+		case err == nil:
+			succeeded++
+		case errors.Is(err, migrations.ErrLocked):
+			locked++
+		default:
+			t.Errorf("Unexpected error from concurrent migrate: %s", err)
+		}
+	}
+
+	if succeeded != 1 {
+		t.Errorf("Expected exactly one concurrent migrate call to succeed, got %d", succeeded)
+	}
+
+	if locked != 1 {
+		t.Errorf("Expected the other concurrent migrate call to time out with ErrLocked, got %d ErrLocked and %d successes", locked, succeeded)
+	}
+
+	if err := tableExists("samples"); err != nil {
+		t.Fatal("Expected the migrations to have run")
+	}
+}
+
+// Confirm MigrateFS/RollbackFS work the same as Migrate/Rollback, against
+// migrations embedded in the binary rather than read from disk.
+func TestFSUp(t *testing.T) {
+	defer clean(t)
+
+	if err := migrateFS(1); err != nil {
+		t.Fatalf("Unable to run migration: %s", err)
+	}
+
+	if err := tableExists("samples"); err != nil {
+		t.Fatal("Sample table not found in database")
+	}
+}
+
+// Make sure revisions work the same from an embedded fs.FS.
+func TestFSRevisions(t *testing.T) {
+	defer clean(t)
+
+	if err := migrateFS(1); err != nil {
+		t.Fatalf("Unable to run migration to revision 1: %s", err)
+	}
+
+	if _, err := conn.Exec("insert into samples (name, email) values ('Bob', 'bob@home.com')"); err == nil {
+		t.Error("Expected inserting an email address to fail")
+	}
+
+	if err := migrateFS(2); err != nil {
+		t.Fatalf("Unable to run migration to revision 2: %s", err)
+	}
+
+	if _, err := conn.Exec("insert into samples (name, email) values ('Bob', 'bob@home.com')"); err != nil {
+		t.Errorf("Expected to be able to insert email address after revision 2: %s", err)
+	}
+}
+
+// Make sure rollbacks work the same from an embedded fs.FS.
+func TestFSDown(t *testing.T) {
+	defer clean(t)
+
+	if err := migrateFS(2); err != nil {
+		t.Fatalf("Unable to run migration to revision 2: %s", err)
+	}
+
+	sub, err := fs.Sub(embeddedSQL, "sql")
+	if err != nil {
+		t.Fatalf("Unable to build embedded sub filesystem: %s", err)
+	}
+
+	if err := migrations.RollbackFS(conn, sub, 1); err != nil {
+		t.Fatalf("Unable to roll back migration to revision 1: %s", err)
+	}
+
+	if _, err := conn.Query("select email from samples"); err == nil {
+		t.Error("Expected the email column to be rolled back")
+	}
+}
+
+// Make sure the /notx flag behaves the same from an embedded fs.FS.
+func TestFSNoTxFlag(t *testing.T) {
+	defer clean(t)
+
+	if err := migrateFS(3); err == nil {
+		t.Error("Expected the /notx migration to generate an error")
+	}
+
+	rows, err := conn.Query("select name from samples where name = 'abc'")
+	if err != nil {
+		t.Errorf("Unable to query for samples: %s", err)
+	}
+
+	var found bool
+	for rows.Next() {
+		found = true
+	}
+
+	if !found {
+		t.Error("Expected the notx migration's first statement to have committed")
+	}
+}
+
+// Confirm MigrateFake records migrations without running their SQL.
+func TestMigrateFakeUp(t *testing.T) {
+	defer clean(t)
+
+	if err := migrations.MigrateFake(conn, "./sql", 2); err != nil {
+		t.Fatalf("Unable to fake migrate to revision 2: %s", err)
+	}
+
+	if err := tableExists("samples"); err == nil {
+		t.Error("Expected the samples table not to exist, since MigrateFake shouldn't run any SQL")
+	}
+
+	rows, err := conn.Query("select migration from schema_migrations order by migration")
+	if err != nil {
+		t.Fatalf("Unable to query schema_migrations: %s", err)
+	}
+	defer rows.Close()
+
+	var count int
+	for rows.Next() {
+		count++
+	}
+
+	if count != 2 {
+		t.Errorf("Expected 2 faked migrations, found %d", count)
+	}
+}
+
+// Confirm MigrateFake can also fake its way back down, removing tracking
+// rows without touching the schema.
+func TestMigrateFakeDown(t *testing.T) {
+	defer clean(t)
+
+	if err := migrations.MigrateFake(conn, "./sql", 2); err != nil {
+		t.Fatalf("Unable to fake migrate to revision 2: %s", err)
+	}
+
+	if err := migrations.MigrateFake(conn, "./sql", 0); err != nil {
+		t.Fatalf("Unable to fake migrate down to revision 0: %s", err)
+	}
+
+	rows, err := conn.Query("select migration from schema_migrations")
+	if err != nil {
+		t.Fatalf("Unable to query schema_migrations: %s", err)
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		t.Error("Expected no migrations to remain after faking back down to revision 0")
+	}
+}
+
+// Confirm a migration can be faked with FakeOne and subsequent migrations
+// still run for real.
+func TestFakeOneThenMigrate(t *testing.T) {
+	defer clean(t)
+
+	if err := migrate(2); err != nil {
+		t.Fatalf("Unable to run migration to revision 2: %s", err)
+	}
+
+	if err := migrations.FakeOne(conn, "./sql", "3-no-tx.sql"); err != nil {
+		t.Fatalf("Unable to fake 3-no-tx.sql: %s", err)
+	}
+
+	if err := migrate(4); err == nil {
+		t.Error("Expected migration 4 to fail, same as when 3-no-tx.sql is skipped by hand")
+	}
+
+	rows, err := conn.Query("select name from samples where name = 'abc'")
+	if err != nil {
+		t.Fatalf("Unable to query for sample names: %s", err)
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		t.Error("Expected migration 3's SQL to have been skipped, not run")
+	}
+}
+
+// Confirm MigrateFake refuses to fake its way past an expand/contract
+// migration rather than silently recording it without the phase/parent
+// bookkeeping Start and Complete rely on.
+func TestMigrateFakeRejectsExpandContract(t *testing.T) {
+	defer clean(t)
+
+	if err := migrations.MigrateFake(conn, "./sql", 5); err == nil {
+		t.Fatal("Expected MigrateFake to refuse to fake 5-split-name-expand-contract.sql")
+	}
+
+	rows, err := conn.Query("select migration from schema_migrations where migration like '5-%'")
+	if err != nil {
+		t.Fatalf("Unable to query schema_migrations: %s", err)
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		t.Error("Expected no row to be recorded for the rejected expand/contract migration")
+	}
+}
+
+// Confirm FakeOne refuses to fake an expand/contract migration by name for
+// the same reason MigrateFake does.
+func TestFakeOneRejectsExpandContract(t *testing.T) {
+	defer clean(t)
+
+	if err := migrations.FakeOne(conn, "./sql", "5-split-name-expand-contract.sql"); err == nil {
+		t.Fatal("Expected FakeOne to refuse to fake 5-split-name-expand-contract.sql")
+	}
+}
+
+// Confirm a Runner's Before/AfterMigrate and Before/AfterEach hooks fire in
+// order, once per migration, with the right direction and tx.
+func TestRunnerHooks(t *testing.T) {
+	defer clean(t)
+
+	var events []string
+
+	r := &migrations.Runner{
+		BeforeMigrate: func() error {
+			events = append(events, "before-migrate")
+			return nil
+		},
+		AfterMigrate: func() error {
+			events = append(events, "after-migrate")
+			return nil
+		},
+		BeforeEach: func(name string, direction migrations.Direction, tx interface{}) error {
+			if tx == nil {
+				t.Errorf("Expected a non-nil tx for %s", name)
+			}
+			events = append(events, fmt.Sprintf("before:%s:%s", name, direction))
+			return nil
+		},
+		AfterEach: func(name string, direction migrations.Direction, tx interface{}) error {
+			events = append(events, fmt.Sprintf("after:%s:%s", name, direction))
+			return nil
+		},
+	}
+
+	if err := r.Migrate(conn, "./sql", 2); err != nil {
+		t.Fatalf("Unable to run migration: %s", err)
+	}
+
+	expected := []string{
+		"before-migrate",
+		"before:1-create-sample.sql:up",
+		"after:1-create-sample.sql:up",
+		"before:2-add-email-to-sample.sql:up",
+		"after:2-add-email-to-sample.sql:up",
+		"after-migrate",
+	}
+
+	if len(events) != len(expected) {
+		t.Fatalf("Expected events %v, got %v", expected, events)
+	}
+
+	for i, e := range expected {
+		if events[i] != e {
+			t.Errorf("Expected event %d to be %q, got %q", i, e, events[i])
+		}
+	}
+}
+
+// Confirm a Runner's OnFailure hook fires, with the underlying error, when a
+// migration fails to apply. Migrating to revision 4 stops at 3-no-tx.sql,
+// the first migration that fails.
+func TestRunnerOnFailure(t *testing.T) {
+	defer clean(t)
+
+	var failed string
+	var failErr error
+
+	r := &migrations.Runner{
+		OnFailure: func(name string, direction migrations.Direction, err error) {
+			failed = name
+			failErr = err
+		},
+	}
+
+	if err := r.Migrate(conn, "./sql", 4); err == nil {
+		t.Fatal("Expected migrating to revision 4 to fail")
+	}
+
+	if failed != "3-no-tx.sql" {
+		t.Errorf("Expected OnFailure to fire for 3-no-tx.sql, got %q", failed)
+	}
+
+	if failErr == nil {
+		t.Error("Expected OnFailure to receive the underlying error")
+	}
+}
+
+// Confirm Check dry-runs pending migrations, rejects the set when a dry run
+// fails, and rolls every dry run back. Every migration in ./sql is pending
+// here and each dry run rolls back on its own, so 2-add-email-to-sample.sql
+// already fails: the samples table from 1-create-sample.sql's dry run is gone.
+func TestCheckCatchesBadSQL(t *testing.T) {
+	defer clean(t)
+
+	if err := migrations.Check(conn, "./sql"); err == nil {
+		t.Fatal("Expected Check to reject a pending migration whose dry run fails")
+	}
+
+	if err := tableExists("samples"); err == nil {
+		t.Error("Expected Check's dry run to have rolled back, leaving the samples table unapplied")
+	}
+}
+
+// Confirm Check skips dry-running a "notx" migration, since its SQL may use
+// statements PostgreSQL refuses inside a transaction block.
+func TestCheckSkipsNoTxDryRun(t *testing.T) {
+	defer clean(t)
+
+	dir := t.TempDir()
+
+	// Revision 5, so the revisions run on into the code migration init
+	// registers at 6 without a gap.
+	writeMigration(t, dir, "5-first.sql", "--- !Up notx\n\ncreate index concurrently on nonexistent_table (id);\n\n--- !Down notx\n\nselect 1;\n")
+
+	if err := migrations.Check(conn, dir); err != nil {
+		t.Fatalf("Expected Check to skip dry-running a notx migration, got: %s", err)
+	}
+}
+
+// Confirm a nil *Runner behaves like the package-level Migrate/Rollback
+// functions, per its documented zero-value behavior.
+func TestNilRunner(t *testing.T) {
+	defer clean(t)
+
+	var r *migrations.Runner
+
+	if err := r.Migrate(conn, "./sql", 2); err != nil {
+		t.Fatalf("Expected a nil Runner to migrate like the package-level function: %s", err)
+	}
+
+	if err := tableExists("samples"); err != nil {
+		t.Fatal("Expected the samples table to be created by a nil Runner's Migrate")
+	}
+}
+
+// Confirm Check rejects a migrations directory with a gap in its revision
+// numbering before ever touching the database.
+func TestCheckRejectsRevisionGap(t *testing.T) {
+	dir := t.TempDir()
+
+	writeMigration(t, dir, "1-first.sql", "--- !Up\n\nselect 1;\n\n--- !Down\n\nselect 1;\n")
+	writeMigration(t, dir, "3-third.sql", "--- !Up\n\nselect 1;\n\n--- !Down\n\nselect 1;\n")
+
+	if err := migrations.Check(conn, dir); err == nil {
+		t.Fatal("Expected Check to reject a gap in revision numbering")
+	}
+
+	if err := tableExists("schema_migrations"); err == nil {
+		t.Error("Expected Check to reject the gap before creating schema_migrations")
+	}
+}
+
+// Confirm Check rejects a migration with an !Up but no !Down, unless it's
+// marked irreversible.
+func TestCheckRejectsMissingDown(t *testing.T) {
+	dir := t.TempDir()
+
+	// Revision 5, so the missing !Down, not a gap before the code migration
+	// init registers at 6, is what Check rejects.
+	writeMigration(t, dir, "5-first.sql", "--- !Up\n\nselect 1;\n")
+
+	if err := migrations.Check(conn, dir); err == nil {
+		t.Fatal("Expected Check to reject a migration with no !Down")
+	}
+
+	if err := tableExists("schema_migrations"); err == nil {
+		t.Error("Expected Check to reject the missing !Down before creating schema_migrations")
+	}
+}
+
+// Confirm Check allows a migration with an !Up but no !Down when it's
+// marked irreversible.
+func TestCheckAllowsIrreversible(t *testing.T) {
+	defer clean(t)
+
+	dir := t.TempDir()
+
+	// Revision 5, so the revisions run on into the code migration init
+	// registers at 6 without a gap.
+	writeMigration(t, dir, "5-first.sql", "--- !Up irreversible\n\ncreate table irreversible_check (id serial primary key);\n")
+
+	if err := migrations.Check(conn, dir); err != nil {
+		t.Fatalf("Expected Check to allow an irreversible migration: %s", err)
+	}
+
+	if err := tableExists("irreversible_check"); err == nil {
+		t.Error("Expected Check's dry run to have rolled back, leaving the table unapplied")
+	}
+}
+
+// writeMigration writes a single migration file to dir, for tests that
+// build their own throwaway migrations directory.
+func writeMigration(t *testing.T, dir, name, contents string) {
+	if err := os.WriteFile(dir+"/"+name, []byte(contents), 0644); err != nil {
+		t.Fatalf("Unable to write %s: %s", name, err)
+	}
+}
+
+// Shortcut to run the embedded test migrations via MigrateFS.
+func migrateFS(revision int) error {
+	sub, err := fs.Sub(embeddedSQL, "sql")
+	if err != nil {
+		return err
+	}
+
+	return migrations.MigrateFS(conn, sub, revision)
+}
+
 // Shortcut to run the test migrations in the sql directory.
 func migrate(revision int) error {
 	return migrations.Migrate(conn, "./sql", revision)
@@ -322,3 +926,24 @@ func tableExists(table string) error {
 
 	return sql.ErrNoRows
 }
+
+// Check if the schema exists. Returns nil if the schema exists.
+func schemaExists(schema string) error {
+	rows, err := conn.Query("select exists (select from information_schema.schemata where schema_name = $1)", schema)
+	if err != nil {
+		return err
+	}
+
+	if rows.Next() {
+		var found bool
+		if err := rows.Scan(&found); err != nil {
+			return err
+		}
+
+		if found {
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
@@ -0,0 +1,111 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Operation is the set of DDL building blocks available to a migration
+// registered in code via Register. Each method executes its statement
+// immediately against the migration's transaction, so failures can be
+// checked and handled inline the same way callers already do with the
+// underlying *sql.Tx.
+type Operation interface {
+	// CreateTable creates table name with the given column definitions,
+	// e.g. CreateTable("samples", "id serial primary key", "name text not null").
+	CreateTable(name string, columns ...string) error
+
+	// DropTable drops table name.
+	DropTable(name string) error
+
+	// RenameTable renames a table from oldName to newName.
+	RenameTable(oldName, newName string) error
+
+	// AddColumn adds column to table with the given type/constraint
+	// definition, e.g. AddColumn("samples", "email", "text").
+	AddColumn(table, column, definition string) error
+
+	// DropColumn drops column from table.
+	DropColumn(table, column string) error
+
+	// RenameColumn renames a column on table from oldName to newName.
+	RenameColumn(table, oldName, newName string) error
+
+	// CreateIndex creates an index named name on table over columns.
+	CreateIndex(name, table string, columns ...string) error
+
+	// Exec runs an arbitrary statement, for anything the helpers above
+	// don't cover, e.g. data backfills.
+	Exec(query string, args ...interface{}) error
+}
+
+// execer is satisfied by both *sql.Tx and *sql.DB, letting operation run
+// against whichever one the current migration is using.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// operation is the default Operation implementation, emitting
+// PostgreSQL-flavored DDL.
+type operation struct {
+	exec execer
+}
+
+func (o *operation) CreateTable(name string, columns ...string) error {
+	return o.Exec(fmt.Sprintf("create table %s (\n\t%s\n)", name, strings.Join(columns, ",\n\t")))
+}
+
+func (o *operation) DropTable(name string) error {
+	return o.Exec(fmt.Sprintf("drop table %s", name))
+}
+
+func (o *operation) RenameTable(oldName, newName string) error {
+	return o.Exec(fmt.Sprintf("alter table %s rename to %s", oldName, newName))
+}
+
+func (o *operation) AddColumn(table, column, definition string) error {
+	return o.Exec(fmt.Sprintf("alter table %s add column %s %s", table, column, definition))
+}
+
+func (o *operation) DropColumn(table, column string) error {
+	return o.Exec(fmt.Sprintf("alter table %s drop column %s", table, column))
+}
+
+func (o *operation) RenameColumn(table, oldName, newName string) error {
+	return o.Exec(fmt.Sprintf("alter table %s rename column %s to %s", table, oldName, newName))
+}
+
+func (o *operation) CreateIndex(name, table string, columns ...string) error {
+	return o.Exec(fmt.Sprintf("create index %s on %s (%s)", name, table, strings.Join(columns, ", ")))
+}
+
+func (o *operation) Exec(query string, args ...interface{}) error {
+	_, err := o.exec.Exec(query, args...)
+	return err
+}
+
+// codeMigration is a migration registered in code via Register.
+type codeMigration struct {
+	Revision int
+	Up       func(Operation) error
+	Down     func(Operation) error
+}
+
+// name is the codeMigration's schema_migrations identifier.
+func (c codeMigration) name() string {
+	return fmt.Sprintf("%d-operation", c.Revision)
+}
+
+// registered holds every migration added via Register, in registration
+// order; loadAll sorts them alongside the SQL files by revision.
+var registered []codeMigration
+
+// Register adds a migration defined in Go rather than as a SQL file. up and
+// down build the change using the Operation passed in, and are driven by
+// Migrate/Rollback exactly like a file-based migration: run in a
+// transaction, recorded in schema_migrations under the same revision
+// ordering, and rolled back by invoking down.
+func Register(revision int, up func(Operation) error, down func(Operation) error) {
+	registered = append(registered, codeMigration{Revision: revision, Up: up, Down: down})
+}